@@ -1,428 +1,32 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
 	"fmt"
-	"math/rand"
 	"net"
 	"os"
 	"os/signal"
 	"strconv"
-	"strings"
-	"syscall"
 	"time"
-	"unsafe"
 
-	"github.com/iovisor/gobpf/elf"
+	"github.com/kinvolk/gobpf-elf-loader/tracer"
 )
 
-type EventType uint32
+var lastTimestamp uint64
 
-const (
-	_ EventType = iota
-	EventConnect
-	EventAccept
-	EventClose
-)
-
-func (e EventType) String() string {
-	switch e {
-	case EventConnect:
-		return "connect"
-	case EventAccept:
-		return "accept"
-	case EventClose:
-		return "close"
-	default:
-		return "unknown"
-	}
-}
-
-type tcpEventV4 struct {
-	// Timestamp must be the first field, the sorting depends on it
-	Timestamp uint64
-
-	Cpu   uint64
-	Type  uint32
-	Pid   uint32
-	Comm  [16]byte
-	SAddr uint32
-	DAddr uint32
-	SPort uint16
-	DPort uint16
-	NetNS uint32
-}
-
-type tcpEventV6 struct {
-	// Timestamp must be the first field, the sorting depends on it
-	Timestamp uint64
-
-	Cpu    uint64
-	Type   uint32
-	Pid    uint32
-	Comm   [16]byte
-	SAddrH uint64
-	SAddrL uint64
-	DAddrH uint64
-	DAddrL uint64
-	SPort  uint16
-	DPort  uint16
-	NetNS  uint32
-}
-
-var byteOrder binary.ByteOrder
-
-// In lack of binary.HostEndian ...
-func init() {
-	var i int32 = 0x01020304
-	u := unsafe.Pointer(&i)
-	pb := (*byte)(u)
-	b := *pb
-	if b == 0x04 {
-		byteOrder = binary.LittleEndian
-	} else {
-		byteOrder = binary.BigEndian
-	}
-}
-
-var lastTimestampV4 uint64
-var lastTimestampV6 uint64
-
-func tcpEventCbV4(event tcpEventV4) {
-	timestamp := uint64(event.Timestamp)
-	cpu := event.Cpu
-	typ := EventType(event.Type)
-	pid := event.Pid & 0xffffffff
-	comm := string(event.Comm[:bytes.IndexByte(event.Comm[:], 0)])
-
-	saddrbuf := make([]byte, 4)
-	daddrbuf := make([]byte, 4)
-
-	binary.LittleEndian.PutUint32(saddrbuf, uint32(event.SAddr))
-	binary.LittleEndian.PutUint32(daddrbuf, uint32(event.DAddr))
-
-	sIP := net.IPv4(saddrbuf[0], saddrbuf[1], saddrbuf[2], saddrbuf[3])
-	dIP := net.IPv4(daddrbuf[0], daddrbuf[1], daddrbuf[2], daddrbuf[3])
-
-	sport := event.SPort
-	dport := event.DPort
-	netns := event.NetNS
-
-	fmt.Printf("%v cpu#%d %s %v %q %v:%v %v:%v %v\n", timestamp, cpu, typ, pid, comm, sIP, sport, dIP, dport, netns)
-
-	if lastTimestampV4 > timestamp {
-		fmt.Printf("ERROR: late event!\n")
-		os.Exit(1)
-	}
-
-	lastTimestampV4 = timestamp
-}
-
-func tcpEventCbV6(event tcpEventV6) {
-	timestamp := uint64(event.Timestamp)
-	cpu := event.Cpu
-	typ := EventType(event.Type)
-	pid := event.Pid & 0xffffffff
-
-	saddrbuf := make([]byte, 16)
-	daddrbuf := make([]byte, 16)
-
-	binary.LittleEndian.PutUint64(saddrbuf, event.SAddrH)
-	binary.LittleEndian.PutUint64(saddrbuf[8:], event.SAddrL)
-	binary.LittleEndian.PutUint64(daddrbuf, event.DAddrH)
-	binary.LittleEndian.PutUint64(daddrbuf[8:], event.DAddrL)
-
-	sIP := net.IP(saddrbuf)
-	dIP := net.IP(daddrbuf)
-
-	sport := event.SPort
-	dport := event.DPort
-	netns := event.NetNS
-
-	fmt.Printf("%v cpu#%d %s %v [%v]:%v [%v]:%v %v\n", timestamp, cpu, typ, pid, sIP, sport, dIP, dport, netns)
-
-	if lastTimestampV6 > timestamp {
-		fmt.Printf("ERROR: late event!\n")
-		os.Exit(1)
-	}
-
-	lastTimestampV6 = timestamp
-}
-
-type tcpTracerState uint64
-
-const (
-	uninitialized tcpTracerState = iota
-	checking
-	checked
-	ready
-)
-
-type guessWhat uint64
-
-const (
-	guessSaddr guessWhat = iota
-	guessDaddr
-	guessFamily
-	guessSport
-	guessDport
-	guessNetns
-	guessDaddrIPv6
-)
-
-type tcpTracerStatus struct {
-	status          tcpTracerState
-	pidTgid         uint64
-	what            guessWhat
-	offsetSaddr     uint64
-	offsetDaddr     uint64
-	offsetSport     uint64
-	offsetDport     uint64
-	offsetNetns     uint64
-	offsetIno       uint64
-	offsetFamily    uint64
-	offsetDaddrIPv6 uint64
-	err             byte
-	saddr           uint32
-	daddr           uint32
-	sport           uint16
-	dport           uint16
-	netns           uint32
-	family          uint16
-	daddrIPv6       [4]uint32
-}
-
-func listen(url, netType string, finish chan struct{}) {
-	l, err := net.Listen(netType, url)
-	if err != nil {
-		fmt.Println("Error listening:", err.Error())
-		os.Exit(1)
-	}
-	fmt.Println("Listening on " + url)
-	select {
-	case <-finish:
-		l.Close()
-		return
-	}
-}
-
-func compareIPv6(a, b [4]uint32) bool {
-	for i := 0; i < 4; i++ {
-		if a[i] != b[i] {
-			return false
-		}
-	}
-	return true
-}
+func tcpEventCb(e tracer.Event) {
+	src := net.JoinHostPort(e.SAddr.String(), strconv.Itoa(int(e.SPort)))
+	dst := net.JoinHostPort(e.DAddr.String(), strconv.Itoa(int(e.DPort)))
+	wall := e.Time.Format("15:04:05.000000")
 
-func ownNetNS() (uint64, error) {
-	var s syscall.Stat_t
-	if err := syscall.Stat("/proc/self/ns/net", &s); err != nil {
-		return 0, err
-	}
-	return s.Ino, nil
-}
+	fmt.Printf("%v %s cpu#%d %s %v %q %s %s %v\n", e.Timestamp, wall, e.CPU, e.Type, e.Pid, e.Comm, src, dst, e.NetNS)
 
-func ipFromUint32Arr(ipv6Addr [4]uint32) net.IP {
-	buf := make([]byte, 16)
-	for i := 0; i < 16; i++ {
-		buf[i] = *(*byte)(unsafe.Pointer((uintptr(unsafe.Pointer(&ipv6Addr[0])) + uintptr(i))))
+	// events arriving later than the reorder window are still delivered,
+	// out of order
+	if lastTimestamp > e.Timestamp {
+		fmt.Printf("WARNING: late event!\n")
 	}
-	return net.IP(buf)
-}
 
-func htons(a uint16) uint16 {
-	arr := make([]byte, 2)
-	binary.BigEndian.PutUint16(arr, a)
-	return byteOrder.Uint16(arr)
-}
-
-func guessOffsets(b *elf.Module) error {
-	listenIP := "127.0.0.2"
-	listenPort := uint16(9091)
-	bindAddress := fmt.Sprintf("%s:%d", listenIP, listenPort)
-
-	finish := make(chan struct{})
-	go listen(bindAddress, "tcp4", finish)
-	time.Sleep(300 * time.Millisecond)
-
-	currentNetns, err := ownNetNS()
-	if err != nil {
-		return fmt.Errorf("error getting current netns: %v", err)
-		os.Exit(1)
-	}
-
-	mp := b.Map("tcptracer_status")
-
-	var zero uint64
-	pidTgid := uint64(os.Getpid()<<32 | syscall.Gettid())
-
-	status := tcpTracerStatus{
-		status:  checking,
-		pidTgid: pidTgid,
-	}
-
-	err = b.UpdateElement(mp, unsafe.Pointer(&zero), unsafe.Pointer(&status), 0)
-	if err != nil {
-		return fmt.Errorf("error: %v", err)
-	}
-
-	dport := htons(listenPort)
-
-	// 127.0.0.1
-	saddr := 0x0100007F
-	// 127.0.0.2
-	daddr := 0x0200007F
-	// will be set later
-	sport := 0
-	netns := uint32(currentNetns)
-	family := syscall.AF_INET
-
-	for status.status != ready {
-		var daddrIPv6 [4]uint32
-
-		daddrIPv6[0] = rand.Uint32()
-		daddrIPv6[1] = rand.Uint32()
-		daddrIPv6[2] = rand.Uint32()
-		daddrIPv6[3] = rand.Uint32()
-
-		ip := ipFromUint32Arr(daddrIPv6)
-
-		if status.what != guessDaddrIPv6 {
-			conn, err := net.Dial("tcp4", bindAddress)
-			if err != nil {
-				fmt.Printf("error: %v\n", err)
-			}
-
-			sport, err = strconv.Atoi(strings.Split(conn.LocalAddr().String(), ":")[1])
-			if err != nil {
-				return fmt.Errorf("error: %v", err)
-			}
-
-			sport = int(htons(uint16(sport)))
-
-			// set SO_LINGER to 0 so the connection state after closing is
-			// CLOSE instead of TIME_WAIT. In this way, they will disappear
-			// from the conntrack table after around 10 seconds instead of 2
-			// minutes
-			if tcpConn, ok := conn.(*net.TCPConn); ok {
-				tcpConn.SetLinger(0)
-			} else {
-				panic("not a tcp connection")
-			}
-
-			conn.Close()
-		} else {
-			conn, err := net.Dial("tcp6", fmt.Sprintf("[%s]:9092", ip))
-			if err == nil {
-				conn.Close()
-			}
-		}
-
-		err = b.LookupElement(mp, unsafe.Pointer(&zero), unsafe.Pointer(&status))
-		if err != nil {
-			return fmt.Errorf("error: %v", err)
-		}
-
-		if status.status == checked {
-			switch status.what {
-			case guessSaddr:
-				if status.saddr == uint32(saddr) {
-					fmt.Println("offsetSaddr found:", status.offsetSaddr)
-					status.what++
-					status.status = checking
-				} else {
-					status.offsetSaddr++
-					status.status = checking
-					status.saddr = uint32(saddr)
-				}
-			case guessDaddr:
-				if status.daddr == uint32(daddr) {
-					fmt.Println("offsetDaddr found:", status.offsetDaddr)
-					status.what++
-					status.status = checking
-				} else {
-					status.offsetDaddr++
-					status.status = checking
-					status.daddr = uint32(daddr)
-				}
-			case guessFamily:
-				if status.family == uint16(family) {
-					fmt.Println("offsetFamily found:", status.offsetFamily)
-					status.what++
-					status.status = checking
-					// we know the sport ((struct inet_sock)->inet_sport) is
-					// after the family field, so we start from there
-					status.offsetSport = status.offsetFamily
-				} else {
-					status.offsetFamily++
-					status.status = checking
-				}
-			case guessSport:
-				if status.sport == uint16(sport) {
-					fmt.Println("offsetSport found:", status.offsetSport)
-					status.what++
-					status.status = checking
-				} else {
-					status.offsetSport++
-					status.status = checking
-				}
-			case guessDport:
-				if status.dport == dport {
-					fmt.Println("offsetDport found:", status.offsetDport)
-					status.what++
-					status.status = checking
-				} else {
-					status.offsetDport++
-					status.status = checking
-				}
-			case guessNetns:
-				if status.netns == netns {
-					fmt.Println("offsetNetns found:", status.offsetNetns)
-					fmt.Println("offsetIno found:", status.offsetIno)
-					status.what++
-					status.status = checking
-				} else {
-					status.offsetIno++
-					// go to the next offsetNetns if we get an error
-					if status.err != 0 || status.offsetIno >= 200 {
-						status.offsetIno = 0
-						status.offsetNetns++
-					}
-					status.status = checking
-				}
-			case guessDaddrIPv6:
-				if compareIPv6(status.daddrIPv6, daddrIPv6) {
-					fmt.Println("offsetDaddrIPv6 found:", status.offsetDaddrIPv6)
-					status.what++
-					status.status = ready
-				} else {
-					status.offsetDaddrIPv6++
-					status.status = checking
-				}
-			default:
-				return fmt.Errorf("Uh, oh!")
-			}
-		}
-
-		err = b.UpdateElement(mp, unsafe.Pointer(&zero), unsafe.Pointer(&status), 0)
-		if err != nil {
-			return fmt.Errorf("error: %v", err)
-		}
-
-		if status.offsetSaddr >= 200 || status.offsetDaddr >= 200 ||
-			status.offsetSport >= 2000 || status.offsetDport >= 200 ||
-			status.offsetNetns >= 200 || status.offsetFamily >= 200 ||
-			status.offsetDaddrIPv6 >= 200 {
-			fmt.Fprintf(os.Stderr, "overflow, bailing out!\n")
-			os.Exit(1)
-		}
-	}
-
-	close(finish)
-
-	return nil
+	lastTimestamp = e.Timestamp
 }
 
 func main() {
@@ -431,76 +35,37 @@ func main() {
 		os.Exit(1)
 	}
 	fileName := os.Args[1]
-	b := elf.NewModule(fileName)
-	if b == nil {
-		fmt.Fprintf(os.Stderr, "System doesn't support BPF\n")
-		os.Exit(1)
-	}
 
-	err := b.Load()
+	t, err := tracer.New(fileName, tracer.Callbacks{
+		OnConnect: tcpEventCb,
+		OnAccept:  tcpEventCb,
+		OnClose:   tcpEventCb,
+		OnDecodeError: func(err error) {
+			fmt.Printf("%v\n", err)
+		},
+	}, tracer.Options{})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
 	}
 
-	for p := range b.IterKprobes() {
-		b.EnableKprobe(p.Name)
-	}
-
-	if err := guessOffsets(b); err != nil {
-		fmt.Fprintf(os.Stderr, "%v\n", err)
-		os.Exit(1)
-	}
-
-	fmt.Printf("Ready.\n")
+	fmt.Printf("offsets found: %+v\n", t.Offsets())
 
-	channelV4 := make(chan []byte)
-	channelV6 := make(chan []byte)
+	// merge the events of all CPUs and of both perf maps in timestamp
+	// order
+	t.SetReorderWindow(100 * time.Millisecond)
 
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt, os.Kill)
 
-	go func() {
-		var event tcpEventV4
-		for {
-			data := <-channelV4
-			err := binary.Read(bytes.NewBuffer(data), byteOrder, &event)
-			if err != nil {
-				fmt.Printf("failed to decode received data: %s\n", err)
-				continue
-			}
-			tcpEventCbV4(event)
-		}
-	}()
+	t.Start()
 
-	go func() {
-		var event tcpEventV6
-		for {
-			data := <-channelV6
-			err := binary.Read(bytes.NewBuffer(data), byteOrder, &event)
-			if err != nil {
-				fmt.Printf("failed to decode received data: %s\n", err)
-				continue
-			}
-			tcpEventCbV6(event)
-		}
-	}()
+	fmt.Printf("Ready.\n")
 
-	pmIPv4, err := elf.InitPerfMap(b, "tcp_event_ipv4", channelV4)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "%v\n", err)
-		os.Exit(1)
-	}
+	<-sig
 
-	pmIPv6, err := elf.InitPerfMap(b, "tcp_event_ipv6", channelV6)
-	if err != nil {
+	if err := t.Stop(); err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
 	}
-
-	pmIPv4.PollStart()
-	pmIPv6.PollStart()
-	<-sig
-	pmIPv4.PollStop()
-	pmIPv6.PollStop()
 }
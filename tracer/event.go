@@ -0,0 +1,219 @@
+package tracer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+type EventType uint32
+
+const (
+	_ EventType = iota
+	EventConnect
+	EventAccept
+	EventClose
+)
+
+func (e EventType) String() string {
+	switch e {
+	case EventConnect:
+		return "connect"
+	case EventAccept:
+		return "accept"
+	case EventClose:
+		return "close"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is a TCP event reported by the eBPF program
+type Event struct {
+	// Timestamp is the bpf_ktime_get_ns() time of the event, Time its
+	// wall-clock equivalent
+	Timestamp uint64
+	Time      time.Time
+
+	CPU  uint64
+	Type EventType
+	Pid  uint32
+	Comm string
+
+	// Family is the stream the event was reported on, AF_INET or
+	// AF_INET6. IPv4-mapped addresses reported on the AF_INET6 stream
+	// are returned in their 4-byte form.
+	Family uint16
+	SAddr  net.IP
+	DAddr  net.IP
+	SPort  uint16
+	DPort  uint16
+	NetNS  uint32
+
+	// Meta is only set if enabled with SetReceiveTimestamps
+	Meta *Metadata
+}
+
+// Metadata describes how an event reached user space
+type Metadata struct {
+	// Received is when the record was read from its perf map. It carries
+	// a monotonic clock reading, like Event.Time, so Received.Sub(Time)
+	// is the kernel to user space delay.
+	Received time.Time
+}
+
+// tcpEventV4 and tcpEventV6 must match the layout of the structs sent by
+// the eBPF program on the tcp_event_ipv4 and tcp_event_ipv6 perf maps
+
+type tcpEventV4 struct {
+	// Timestamp must be the first field, the sorting depends on it
+	Timestamp uint64
+
+	Cpu   uint64
+	Type  uint32
+	Pid   uint32
+	Comm  [16]byte
+	SAddr uint32
+	DAddr uint32
+	SPort uint16
+	DPort uint16
+	NetNS uint32
+}
+
+type tcpEventV6 struct {
+	// Timestamp must be the first field, the sorting depends on it
+	Timestamp uint64
+
+	Cpu    uint64
+	Type   uint32
+	Pid    uint32
+	Comm   [16]byte
+	SAddrH uint64
+	SAddrL uint64
+	DAddrH uint64
+	DAddrL uint64
+	SPort  uint16
+	DPort  uint16
+	NetNS  uint32
+}
+
+var byteOrder binary.ByteOrder
+
+// In lack of binary.HostEndian ...
+func init() {
+	var i int32 = 0x01020304
+	u := unsafe.Pointer(&i)
+	pb := (*byte)(u)
+	b := *pb
+	if b == 0x04 {
+		byteOrder = binary.LittleEndian
+	} else {
+		byteOrder = binary.BigEndian
+	}
+}
+
+// decodeEvent decodes a perf record into out, a pointer to a fixed-size
+// struct, using the host byte order. The kernel pads raw samples to 8
+// bytes, so data may be longer than the struct but never shorter.
+func decodeEvent(data []byte, out interface{}) error {
+	size := binary.Size(out)
+	if size < 0 {
+		return fmt.Errorf("cannot decode into %T: not a fixed-size type", out)
+	}
+	if len(data) < size {
+		return fmt.Errorf("record too short for %T: got %d bytes, want %d", out, len(data), size)
+	}
+	return binary.Read(bytes.NewReader(data), byteOrder, out)
+}
+
+// DecodeError reports a perf record that doesn't match the event layout,
+// usually because the Go and C structs have drifted apart
+type DecodeError struct {
+	// Map is the perf map the record was read from
+	Map  string
+	Data []byte
+	Err  error
+}
+
+func (e *DecodeError) Error() string {
+	const maxDump = 32
+
+	dump := fmt.Sprintf("% x", e.Data)
+	if len(e.Data) > maxDump {
+		dump = fmt.Sprintf("% x ...", e.Data[:maxDump])
+	}
+	return fmt.Sprintf("failed to decode received data from %s (%d bytes: %s): %v", e.Map, len(e.Data), dump, e.Err)
+}
+
+// Unwrap returns the underlying decoding error
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// normalizeIP returns IPv4-mapped IPv6 addresses (::ffff:a.b.c.d) in
+// their 4-byte form, leaving other addresses untouched
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func commString(comm []byte) string {
+	if i := bytes.IndexByte(comm, 0); i >= 0 {
+		comm = comm[:i]
+	}
+	return string(comm)
+}
+
+func (e *tcpEventV4) event(bootTime time.Time) Event {
+	saddrbuf := make([]byte, 4)
+	daddrbuf := make([]byte, 4)
+
+	binary.LittleEndian.PutUint32(saddrbuf, uint32(e.SAddr))
+	binary.LittleEndian.PutUint32(daddrbuf, uint32(e.DAddr))
+
+	return Event{
+		Timestamp: e.Timestamp,
+		Time:      bootTime.Add(time.Duration(e.Timestamp)),
+		CPU:       e.Cpu,
+		Type:      EventType(e.Type),
+		Pid:       e.Pid & 0xffffffff,
+		Comm:      commString(e.Comm[:]),
+		Family:    syscall.AF_INET,
+		SAddr:     net.IPv4(saddrbuf[0], saddrbuf[1], saddrbuf[2], saddrbuf[3]).To4(),
+		DAddr:     net.IPv4(daddrbuf[0], daddrbuf[1], daddrbuf[2], daddrbuf[3]).To4(),
+		SPort:     e.SPort,
+		DPort:     e.DPort,
+		NetNS:     e.NetNS,
+	}
+}
+
+func (e *tcpEventV6) event(bootTime time.Time) Event {
+	saddrbuf := make([]byte, 16)
+	daddrbuf := make([]byte, 16)
+
+	binary.LittleEndian.PutUint64(saddrbuf, e.SAddrH)
+	binary.LittleEndian.PutUint64(saddrbuf[8:], e.SAddrL)
+	binary.LittleEndian.PutUint64(daddrbuf, e.DAddrH)
+	binary.LittleEndian.PutUint64(daddrbuf[8:], e.DAddrL)
+
+	return Event{
+		Timestamp: e.Timestamp,
+		Time:      bootTime.Add(time.Duration(e.Timestamp)),
+		CPU:       e.Cpu,
+		Type:      EventType(e.Type),
+		Pid:       e.Pid & 0xffffffff,
+		Comm:      commString(e.Comm[:]),
+		Family:    syscall.AF_INET6,
+		SAddr:     normalizeIP(net.IP(saddrbuf)),
+		DAddr:     normalizeIP(net.IP(daddrbuf)),
+		SPort:     e.SPort,
+		DPort:     e.DPort,
+		NetNS:     e.NetNS,
+	}
+}
@@ -0,0 +1,190 @@
+package tracer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func encode(t *testing.T, v interface{}) []byte {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, byteOrder, v); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeEvent(t *testing.T) {
+	want := tcpEventV4{Timestamp: 42, Pid: 1234, SPort: 80, NetNS: 4026531992}
+	record := encode(t, &want)
+
+	for _, tt := range []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{"exact", record, false},
+		{"padded", append(append([]byte(nil), record...), 0, 0, 0, 0), false},
+		{"short", record[:len(record)-1], true},
+		{"empty", nil, true},
+	} {
+		var got tcpEventV4
+		err := decodeEvent(tt.data, &got)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, want)
+		}
+	}
+
+	var notFixed struct{ Comm string }
+	if err := decodeEvent(record, &notFixed); err == nil {
+		t.Error("expected an error decoding into a struct with a string")
+	}
+}
+
+func TestNormalizeIP(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want net.IP
+	}{
+		{"::ffff:10.0.0.1", net.IP{10, 0, 0, 1}},
+		{"10.0.0.1", net.IP{10, 0, 0, 1}},
+		{"2001:db8::1", net.ParseIP("2001:db8::1")},
+		{"::1", net.ParseIP("::1")},
+	} {
+		got := normalizeIP(net.ParseIP(tt.in))
+		if !got.Equal(tt.want) || len(got) != len(tt.want) {
+			t.Errorf("normalizeIP(%s) = %v (%d bytes), want %v (%d bytes)", tt.in, got, len(got), tt.want, len(tt.want))
+		}
+	}
+}
+
+func TestEventConversion(t *testing.T) {
+	bootTime := time.Unix(1000, 0)
+
+	for _, tt := range []struct {
+		name string
+		got  Event
+		want Event
+	}{
+		{
+			name: "ipv4",
+			got: (&tcpEventV4{
+				Timestamp: 5,
+				Cpu:       2,
+				Type:      uint32(EventConnect),
+				Pid:       1234,
+				Comm:      [16]byte{'c', 'u', 'r', 'l'},
+				SAddr:     0x0100007F, // 127.0.0.1
+				DAddr:     0x0200007F, // 127.0.0.2
+				SPort:     40000,
+				DPort:     9091,
+				NetNS:     7,
+			}).event(bootTime),
+			want: Event{
+				Timestamp: 5,
+				Time:      bootTime.Add(5),
+				CPU:       2,
+				Type:      EventConnect,
+				Pid:       1234,
+				Comm:      "curl",
+				Family:    syscall.AF_INET,
+				SAddr:     net.IP{127, 0, 0, 1},
+				DAddr:     net.IP{127, 0, 0, 2},
+				SPort:     40000,
+				DPort:     9091,
+				NetNS:     7,
+			},
+		},
+		{
+			name: "ipv6",
+			got: (&tcpEventV6{
+				Timestamp: 6,
+				Type:      uint32(EventAccept),
+				Comm:      [16]byte{'0', '1', '2', '3', '4', '5', '6', '7', '8', '9', 'a', 'b', 'c', 'd', 'e', 'f'},
+				SAddrH:    0x00000000b80d0120, // 2001:db8::1
+				SAddrL:    0x0100000000000000,
+				DAddrH:    0,
+				DAddrL:    0x0100000000000000, // ::1
+			}).event(bootTime),
+			want: Event{
+				Timestamp: 6,
+				Time:      bootTime.Add(6),
+				Type:      EventAccept,
+				Comm:      "0123456789abcdef",
+				Family:    syscall.AF_INET6,
+				SAddr:     net.ParseIP("2001:db8::1"),
+				DAddr:     net.ParseIP("::1"),
+			},
+		},
+		{
+			name: "ipv4-mapped ipv6",
+			got: (&tcpEventV6{
+				Type:   uint32(EventClose),
+				SAddrL: 0x0100000affff0000, // ::ffff:10.0.0.1
+				DAddrL: 0x0200000affff0000, // ::ffff:10.0.0.2
+			}).event(bootTime),
+			want: Event{
+				Time:   bootTime,
+				Type:   EventClose,
+				Family: syscall.AF_INET6,
+				SAddr:  net.IP{10, 0, 0, 1},
+				DAddr:  net.IP{10, 0, 0, 2},
+			},
+		},
+	} {
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	long := make([]byte, 40)
+	for i := range long {
+		long[i] = byte(i)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		data    []byte
+		want    string
+		notWant string
+	}{
+		{"short record", []byte{1, 2, 3, 4}, "(4 bytes: 01 02 03 04)", "..."},
+		{"truncated dump", long, "(40 bytes: 00 01 02", "20 21"},
+	} {
+		err := &DecodeError{Map: "tcp_event_ipv4", Data: tt.data, Err: io.ErrUnexpectedEOF}
+		msg := err.Error()
+		if !strings.Contains(msg, "tcp_event_ipv4") || !strings.Contains(msg, tt.want) {
+			t.Errorf("%s: %q does not contain the map and %q", tt.name, msg, tt.want)
+		}
+		if strings.Contains(msg, tt.notWant) {
+			t.Errorf("%s: %q contains %q", tt.name, msg, tt.notWant)
+		}
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("%s: errors.Is does not find the underlying error", tt.name)
+		}
+	}
+
+	msg := (&DecodeError{Data: long, Err: io.ErrUnexpectedEOF}).Error()
+	if !strings.Contains(msg, "1e 1f ...") {
+		t.Errorf("%q does not end the dump after 32 bytes", msg)
+	}
+}
@@ -0,0 +1,296 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/iovisor/gobpf/elf"
+)
+
+type tcpTracerState uint64
+
+const (
+	uninitialized tcpTracerState = iota
+	checking
+	checked
+	ready
+)
+
+type guessWhat uint64
+
+const (
+	guessSaddr guessWhat = iota
+	guessDaddr
+	guessFamily
+	guessSport
+	guessDport
+	guessNetns
+	guessDaddrIPv6
+)
+
+type tcpTracerStatus struct {
+	status          tcpTracerState
+	pidTgid         uint64
+	what            guessWhat
+	offsetSaddr     uint64
+	offsetDaddr     uint64
+	offsetSport     uint64
+	offsetDport     uint64
+	offsetNetns     uint64
+	offsetIno       uint64
+	offsetFamily    uint64
+	offsetDaddrIPv6 uint64
+	err             byte
+	saddr           uint32
+	daddr           uint32
+	sport           uint16
+	dport           uint16
+	netns           uint32
+	family          uint16
+	daddrIPv6       [4]uint32
+}
+
+func compareIPv6(a, b [4]uint32) bool {
+	for i := 0; i < 4; i++ {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func ownNetNS() (uint64, error) {
+	var s syscall.Stat_t
+	if err := syscall.Stat("/proc/self/ns/net", &s); err != nil {
+		return 0, err
+	}
+	return s.Ino, nil
+}
+
+func ipFromUint32Arr(ipv6Addr [4]uint32) net.IP {
+	buf := make([]byte, 16)
+	for i := 0; i < 16; i++ {
+		buf[i] = *(*byte)(unsafe.Pointer((uintptr(unsafe.Pointer(&ipv6Addr[0])) + uintptr(i))))
+	}
+	return net.IP(buf)
+}
+
+func htons(a uint16) uint16 {
+	arr := make([]byte, 2)
+	binary.BigEndian.PutUint16(arr, a)
+	return byteOrder.Uint16(arr)
+}
+
+// Offsets are the offsets of the fields the eBPF program reads, as found
+// by guessing
+type Offsets struct {
+	Saddr     uint64
+	Daddr     uint64
+	Sport     uint64
+	Dport     uint64
+	Netns     uint64
+	Ino       uint64
+	Family    uint64
+	DaddrIPv6 uint64
+}
+
+func guessOffsets(b *elf.Module) (Offsets, error) {
+	listenIP := "127.0.0.2"
+	listenPort := uint16(9091)
+	bindAddress := net.JoinHostPort(listenIP, strconv.Itoa(int(listenPort)))
+
+	// the connections only need to complete the handshake, so nothing
+	// accepts them; the listener is closed on every return path so a
+	// retry can bind again
+	l, err := net.Listen("tcp4", bindAddress)
+	if err != nil {
+		return Offsets{}, fmt.Errorf("error listening on %s: %v", bindAddress, err)
+	}
+	defer l.Close()
+
+	currentNetns, err := ownNetNS()
+	if err != nil {
+		return Offsets{}, fmt.Errorf("error getting current netns: %v", err)
+	}
+
+	mp := b.Map("tcptracer_status")
+	if mp == nil {
+		return Offsets{}, fmt.Errorf("map tcptracer_status not found")
+	}
+
+	var zero uint64
+	pidTgid := uint64(os.Getpid()<<32 | syscall.Gettid())
+
+	status := tcpTracerStatus{
+		status:  checking,
+		pidTgid: pidTgid,
+	}
+
+	err = b.UpdateElement(mp, unsafe.Pointer(&zero), unsafe.Pointer(&status), 0)
+	if err != nil {
+		return Offsets{}, fmt.Errorf("error updating tcptracer_status: %v", err)
+	}
+
+	dport := htons(listenPort)
+
+	// 127.0.0.1
+	saddr := 0x0100007F
+	// 127.0.0.2
+	daddr := 0x0200007F
+	// will be set later
+	sport := 0
+	netns := uint32(currentNetns)
+	family := syscall.AF_INET
+
+	for status.status != ready {
+		var daddrIPv6 [4]uint32
+
+		daddrIPv6[0] = rand.Uint32()
+		daddrIPv6[1] = rand.Uint32()
+		daddrIPv6[2] = rand.Uint32()
+		daddrIPv6[3] = rand.Uint32()
+
+		ip := ipFromUint32Arr(daddrIPv6)
+
+		if status.what != guessDaddrIPv6 {
+			conn, err := net.Dial("tcp4", bindAddress)
+			if err != nil {
+				return Offsets{}, fmt.Errorf("error connecting to %s: %v", bindAddress, err)
+			}
+
+			sport, err = strconv.Atoi(strings.Split(conn.LocalAddr().String(), ":")[1])
+			if err != nil {
+				conn.Close()
+				return Offsets{}, fmt.Errorf("error parsing local port: %v", err)
+			}
+
+			sport = int(htons(uint16(sport)))
+
+			// set SO_LINGER to 0 so the connection state after closing is
+			// CLOSE instead of TIME_WAIT. In this way, they will disappear
+			// from the conntrack table after around 10 seconds instead of 2
+			// minutes
+			tcpConn, ok := conn.(*net.TCPConn)
+			if !ok {
+				conn.Close()
+				return Offsets{}, fmt.Errorf("not a tcp connection: %T", conn)
+			}
+			tcpConn.SetLinger(0)
+
+			conn.Close()
+		} else {
+			conn, err := net.Dial("tcp6", fmt.Sprintf("[%s]:9092", ip))
+			if err == nil {
+				conn.Close()
+			}
+		}
+
+		err = b.LookupElement(mp, unsafe.Pointer(&zero), unsafe.Pointer(&status))
+		if err != nil {
+			return Offsets{}, fmt.Errorf("error reading tcptracer_status: %v", err)
+		}
+
+		if status.status == checked {
+			switch status.what {
+			case guessSaddr:
+				if status.saddr == uint32(saddr) {
+					status.what++
+					status.status = checking
+				} else {
+					status.offsetSaddr++
+					status.status = checking
+					status.saddr = uint32(saddr)
+				}
+			case guessDaddr:
+				if status.daddr == uint32(daddr) {
+					status.what++
+					status.status = checking
+				} else {
+					status.offsetDaddr++
+					status.status = checking
+					status.daddr = uint32(daddr)
+				}
+			case guessFamily:
+				if status.family == uint16(family) {
+					status.what++
+					status.status = checking
+					// we know the sport ((struct inet_sock)->inet_sport) is
+					// after the family field, so we start from there
+					status.offsetSport = status.offsetFamily
+				} else {
+					status.offsetFamily++
+					status.status = checking
+				}
+			case guessSport:
+				if status.sport == uint16(sport) {
+					status.what++
+					status.status = checking
+				} else {
+					status.offsetSport++
+					status.status = checking
+				}
+			case guessDport:
+				if status.dport == dport {
+					status.what++
+					status.status = checking
+				} else {
+					status.offsetDport++
+					status.status = checking
+				}
+			case guessNetns:
+				if status.netns == netns {
+					status.what++
+					status.status = checking
+				} else {
+					status.offsetIno++
+					// go to the next offsetNetns if we get an error
+					if status.err != 0 || status.offsetIno >= 200 {
+						status.offsetIno = 0
+						status.offsetNetns++
+					}
+					status.status = checking
+				}
+			case guessDaddrIPv6:
+				if compareIPv6(status.daddrIPv6, daddrIPv6) {
+					status.what++
+					status.status = ready
+				} else {
+					status.offsetDaddrIPv6++
+					status.status = checking
+				}
+			default:
+				return Offsets{}, fmt.Errorf("unexpected guess state %d", status.what)
+			}
+		}
+
+		err = b.UpdateElement(mp, unsafe.Pointer(&zero), unsafe.Pointer(&status), 0)
+		if err != nil {
+			return Offsets{}, fmt.Errorf("error updating tcptracer_status: %v", err)
+		}
+
+		if status.offsetSaddr >= 200 || status.offsetDaddr >= 200 ||
+			status.offsetSport >= 2000 || status.offsetDport >= 200 ||
+			status.offsetNetns >= 200 || status.offsetFamily >= 200 ||
+			status.offsetDaddrIPv6 >= 200 {
+			return Offsets{}, fmt.Errorf("offsets not found after too many attempts, guessing %d", status.what)
+		}
+	}
+
+	return Offsets{
+		Saddr:     status.offsetSaddr,
+		Daddr:     status.offsetDaddr,
+		Sport:     status.offsetSport,
+		Dport:     status.offsetDport,
+		Netns:     status.offsetNetns,
+		Ino:       status.offsetIno,
+		Family:    status.offsetFamily,
+		DaddrIPv6: status.offsetDaddrIPv6,
+	}, nil
+}
@@ -0,0 +1,88 @@
+package tracer
+
+import (
+	"container/heap"
+	"time"
+)
+
+// eventHeap holds the events buffered for ordered delivery, the oldest
+// first
+type eventHeap []Event
+
+func (h eventHeap) Len() int           { return len(h) }
+func (h eventHeap) Less(i, j int) bool { return h[i].Timestamp < h[j].Timestamp }
+func (h eventHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *eventHeap) Push(x interface{}) {
+	*h = append(*h, x.(Event))
+}
+
+func (h *eventHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	*h = old[:n-1]
+	return e
+}
+
+// SetReorderWindow enables ordered delivery: events from all CPUs and
+// both address families are buffered until window after they were
+// recorded and delivered from a single goroutine in timestamp order. The
+// buffer is checked every window/4, at most every 10ms, so an event is
+// delivered between window and window plus that interval after it was
+// recorded. An event arriving more than
+// window after it was recorded is delivered late, as soon as possible,
+// and events still buffered on Stop are dropped. It must be called
+// before Start; zero, the default, disables it.
+func (t *Tracer) SetReorderWindow(window time.Duration) {
+	t.reorderWindow = window
+}
+
+func (t *Tracer) reorder(events <-chan Event) {
+	ticker := time.NewTicker(tickInterval(t.reorderWindow))
+	defer ticker.Stop()
+
+	t.reorderLoop(events, ticker.C, func() time.Duration {
+		return time.Since(t.bootTime)
+	})
+}
+
+// maxTickInterval bounds how long events are held past the window
+const maxTickInterval = 10 * time.Millisecond
+
+// tickInterval returns how often the buffer is checked for window
+func tickInterval(window time.Duration) time.Duration {
+	interval := window / 4
+	if interval > maxTickInterval {
+		interval = maxTickInterval
+	}
+	if interval <= 0 {
+		// time.NewTicker needs a positive interval
+		interval = window
+	}
+	return interval
+}
+
+// reorderLoop buffers events and, on each tick, delivers those recorded
+// at least one window before now, the current bpf_ktime_get_ns() time
+func (t *Tracer) reorderLoop(events <-chan Event, tick <-chan time.Time, now func() time.Duration) {
+	var h eventHeap
+
+	for {
+		select {
+		case <-t.stop:
+			return
+		case e := <-events:
+			heap.Push(&h, e)
+		case <-tick:
+			n := now()
+			if n < t.reorderWindow {
+				continue
+			}
+			deadline := uint64(n - t.reorderWindow)
+			for h.Len() > 0 && h[0].Timestamp <= deadline {
+				t.dispatch(heap.Pop(&h).(Event))
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package tracer
+
+import (
+	"container/heap"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEventHeap(t *testing.T) {
+	var h eventHeap
+	for _, ts := range []uint64{30, 10, 50, 20, 40} {
+		heap.Push(&h, Event{Timestamp: ts})
+	}
+
+	var got []uint64
+	for h.Len() > 0 {
+		got = append(got, heap.Pop(&h).(Event).Timestamp)
+	}
+
+	want := []uint64{10, 20, 30, 40, 50}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestReorderLoop(t *testing.T) {
+	delivered := make(chan uint64, 16)
+	tr := &Tracer{
+		reorderWindow: 10,
+		stop:          make(chan struct{}),
+		callbacks: Callbacks{
+			OnConnect: func(e Event) { delivered <- e.Timestamp },
+		},
+	}
+	defer close(tr.stop)
+
+	events := make(chan Event)
+	tick := make(chan time.Time)
+	// only written before a send on tick, and read after the loop
+	// receives it
+	var now time.Duration
+
+	go tr.reorderLoop(events, tick, func() time.Duration { return now })
+
+	send := func(timestamps ...uint64) {
+		for _, ts := range timestamps {
+			events <- Event{Timestamp: ts, Type: EventConnect}
+		}
+	}
+	advance := func(to time.Duration) {
+		now = to
+		tick <- time.Time{}
+		// the loop handles one case at a time, so once it accepts this
+		// event the tick has been processed
+		events <- Event{Timestamp: ^uint64(0), Type: EventConnect}
+	}
+
+	for _, tt := range []struct {
+		name   string
+		send   []uint64
+		now    time.Duration
+		expect []uint64
+	}{
+		{"before the first window", []uint64{30, 10, 20}, 5, nil},
+		{"releases events older than the window", nil, 25, []uint64{10}},
+		{"releases the rest in order", nil, 45, []uint64{20, 30}},
+		{"still delivers late events", []uint64{5}, 45, []uint64{5}},
+		{"keeps events inside the window", []uint64{40}, 45, nil},
+	} {
+		send(tt.send...)
+		advance(tt.now)
+
+		var got []uint64
+	drain:
+		for {
+			select {
+			case ts := <-delivered:
+				got = append(got, ts)
+			default:
+				break drain
+			}
+		}
+		if !reflect.DeepEqual(got, tt.expect) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.expect)
+		}
+	}
+}
+
+func TestTickInterval(t *testing.T) {
+	for _, tt := range []struct {
+		window, want time.Duration
+	}{
+		{3, 3},
+		{4, 1},
+		{20 * time.Millisecond, 5 * time.Millisecond},
+		{40 * time.Millisecond, 10 * time.Millisecond},
+		{time.Second, 10 * time.Millisecond},
+	} {
+		if got := tickInterval(tt.window); got != tt.want {
+			t.Errorf("tickInterval(%v) = %v, want %v", tt.window, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package tracer
+
+import "sync/atomic"
+
+// MapStats counts the records read from one perf map
+type MapStats struct {
+	Received     uint64
+	DecodeErrors uint64
+}
+
+// Stats aggregates the record counts of all perf maps polled by a tracer.
+// Lost records are not included: the perf reader does not report them.
+type Stats struct {
+	Received     uint64
+	DecodeErrors uint64
+	Maps         map[string]MapStats
+}
+
+type mapCounters struct {
+	received     uint64
+	decodeErrors uint64
+}
+
+func (c *mapCounters) stats() MapStats {
+	return MapStats{
+		Received:     atomic.LoadUint64(&c.received),
+		DecodeErrors: atomic.LoadUint64(&c.decodeErrors),
+	}
+}
+
+// Stats returns the record counts since Start; it is safe to call
+// concurrently with polling
+func (t *Tracer) Stats() Stats {
+	s := Stats{
+		Maps: map[string]MapStats{
+			"tcp_event_ipv4": t.countersV4.stats(),
+			"tcp_event_ipv6": t.countersV6.stats(),
+		},
+	}
+	for _, m := range s.Maps {
+		s.Received += m.Received
+		s.DecodeErrors += m.DecodeErrors
+	}
+	return s
+}
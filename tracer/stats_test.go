@@ -0,0 +1,42 @@
+package tracer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		v4, v6 mapCounters
+		want   Stats
+	}{
+		{
+			name: "empty",
+			want: Stats{
+				Maps: map[string]MapStats{
+					"tcp_event_ipv4": {},
+					"tcp_event_ipv6": {},
+				},
+			},
+		},
+		{
+			name: "both maps",
+			v4:   mapCounters{received: 10, decodeErrors: 1},
+			v6:   mapCounters{received: 5, decodeErrors: 2},
+			want: Stats{
+				Received:     15,
+				DecodeErrors: 3,
+				Maps: map[string]MapStats{
+					"tcp_event_ipv4": {Received: 10, DecodeErrors: 1},
+					"tcp_event_ipv6": {Received: 5, DecodeErrors: 2},
+				},
+			},
+		},
+	} {
+		tr := &Tracer{countersV4: tt.v4, countersV6: tt.v6}
+		if got := tr.Stats(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
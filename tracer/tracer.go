@@ -0,0 +1,476 @@
+package tracer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/iovisor/gobpf/elf"
+)
+
+// Callbacks are called for each event of their type; nil callbacks are
+// skipped. Events of one family are delivered from a single goroutine,
+// IPv4 and IPv6 events concurrently, unless ordered delivery is enabled
+// with SetReorderWindow. Callbacks must not call Stop: it waits for the
+// pollers, which wait for the callbacks to return.
+type Callbacks struct {
+	OnConnect func(Event)
+	OnAccept  func(Event)
+	OnClose   func(Event)
+
+	// OnDecodeError is called with a *DecodeError for each record that
+	// can't be decoded. The record is skipped and counted in Stats; set
+	// Options.StopOnDecodeError to treat it as fatal.
+	OnDecodeError func(error)
+}
+
+// Options configure New. The zero value gives the default behaviour.
+type Options struct {
+	// KeepRlimits stops New from raising RLIMIT_MEMLOCK and
+	// RLIMIT_NOFILE, which apply to the whole process, for callers that
+	// manage them themselves
+	KeepRlimits bool
+
+	// StopOnDecodeError makes the tracer stop itself on the first record
+	// that can't be decoded. No events are delivered after it, Done is
+	// closed once stopped and Err returns the *DecodeError.
+	StopOnDecodeError bool
+}
+
+// Tracer loads a tcptracer-bpf object, guesses the kernel struct offsets
+// it needs and delivers the TCP events it reports
+type Tracer struct {
+	// accessed atomically, first so they are 64-bit aligned on 32-bit
+	// platforms
+	countersV4 mapCounters
+	countersV6 mapCounters
+
+	m           *elf.Module
+	perfMapIPv4 *elf.PerfMap
+	perfMapIPv6 *elf.PerfMap
+	channelV4   chan []byte
+	channelV6   chan []byte
+	callbacks   Callbacks
+	bootTime    time.Time
+	stop        chan struct{}
+	stopOnce    sync.Once
+	done        chan struct{}
+	closeErr    error
+
+	stopOnDecodeError bool
+	errMu             sync.Mutex
+	err               error
+
+	// stateMu guards started and stopped, so Start can't race Stop
+	stateMu sync.Mutex
+	started bool
+	stopped bool
+
+	reorderWindow time.Duration
+	ordered       chan Event
+
+	netns map[uint32]struct{}
+
+	// attached lists the kprobe sections enabled by load
+	attachedMu sync.Mutex
+	attached   []string
+
+	receiveTimestamps bool
+
+	offsets Offsets
+}
+
+// New loads the object at objPath, attaches its kprobes and guesses the
+// offsets. Events are delivered once Start is called.
+func New(objPath string, callbacks Callbacks, opts Options) (*Tracer, error) {
+	// elf.NewModule only reports a nil module, so open the object file
+	// first to tell a missing or unreadable file apart from missing BPF
+	// support
+	f, err := os.Open(objPath)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	bootTime, err := getBootTime()
+	if err != nil {
+		return nil, err
+	}
+
+	// raising the limit needs CAP_SYS_RESOURCE, and since 5.11 maps are
+	// charged to the memory cgroup instead, so a failure only matters
+	// if Load fails too
+	var memlockErr error
+	if !opts.KeepRlimits {
+		memlockErr = raiseMemlockLimit()
+	}
+
+	m := elf.NewModule(objPath)
+	if m == nil {
+		return nil, fmt.Errorf("system doesn't support BPF")
+	}
+
+	t := &Tracer{
+		m:         m,
+		channelV4: make(chan []byte),
+		channelV6: make(chan []byte),
+		callbacks: callbacks,
+		bootTime:  bootTime,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+
+		stopOnDecodeError: opts.StopOnDecodeError,
+	}
+	if err := t.load(opts, memlockErr); err != nil {
+		m.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Tracer) load(opts Options, memlockErr error) error {
+	if err := t.m.Load(); err != nil {
+		if memlockErr != nil {
+			return fmt.Errorf("%v (%v)", err, memlockErr)
+		}
+		return err
+	}
+
+	for p := range t.m.IterKprobes() {
+		if err := t.m.EnableKprobe(p.Name); err != nil {
+			symbol := p.Name[strings.Index(p.Name, "/")+1:]
+			if ok, serr := symbolExists("/proc/kallsyms", symbol); serr == nil && !ok {
+				err = fmt.Errorf("symbol %s not found on this kernel: %v", symbol, err)
+			}
+			return fmt.Errorf("error enabling %s: %v", p.Name, err)
+		}
+		t.attachedMu.Lock()
+		t.attached = append(t.attached, p.Name)
+		t.attachedMu.Unlock()
+	}
+
+	offsets, err := guessOffsets(t.m)
+	if err != nil {
+		return err
+	}
+	t.offsets = offsets
+
+	// each perf map takes one perf event fd per CPU. Like the memlock
+	// limit, a failure to raise it only matters if InitPerfMap fails.
+	var nofileErr error
+	if !opts.KeepRlimits {
+		nofileErr = raiseNofileLimit()
+	}
+
+	t.perfMapIPv4, err = elf.InitPerfMap(t.m, "tcp_event_ipv4", t.channelV4)
+	if err != nil {
+		return perfMapError("tcp_event_ipv4", err, nofileErr)
+	}
+
+	t.perfMapIPv6, err = elf.InitPerfMap(t.m, "tcp_event_ipv6", t.channelV6)
+	if err != nil {
+		return perfMapError("tcp_event_ipv6", err, nofileErr)
+	}
+
+	return nil
+}
+
+// Start starts polling the perf maps. The perf events are already opened
+// and mmapped by New, so events are buffered in the rings until then.
+// Calling it again, or after Stop, has no effect.
+func (t *Tracer) Start() {
+	t.stateMu.Lock()
+	defer t.stateMu.Unlock()
+
+	if t.started || t.stopped {
+		return
+	}
+	t.started = true
+
+	if t.reorderWindow > 0 {
+		t.ordered = make(chan Event)
+		go t.reorder(t.ordered)
+	}
+
+	go func() {
+		var event tcpEventV4
+		for {
+			select {
+			case <-t.stop:
+				return
+			case data, ok := <-t.channelV4:
+				// newer gobpf versions close the channel on PollStop
+				if !ok {
+					return
+				}
+				meta := t.metadata()
+				atomic.AddUint64(&t.countersV4.received, 1)
+				err := decodeEvent(data, &event)
+				if err != nil {
+					atomic.AddUint64(&t.countersV4.decodeErrors, 1)
+					t.decodeError(&DecodeError{Map: "tcp_event_ipv4", Data: data, Err: err})
+					continue
+				}
+				e := event.event(t.bootTime)
+				e.Meta = meta
+				t.deliver(e)
+			}
+		}
+	}()
+
+	go func() {
+		var event tcpEventV6
+		for {
+			select {
+			case <-t.stop:
+				return
+			case data, ok := <-t.channelV6:
+				if !ok {
+					return
+				}
+				meta := t.metadata()
+				atomic.AddUint64(&t.countersV6.received, 1)
+				err := decodeEvent(data, &event)
+				if err != nil {
+					atomic.AddUint64(&t.countersV6.decodeErrors, 1)
+					t.decodeError(&DecodeError{Map: "tcp_event_ipv6", Data: data, Err: err})
+					continue
+				}
+				e := event.event(t.bootTime)
+				e.Meta = meta
+				t.deliver(e)
+			}
+		}
+	}()
+
+	t.perfMapIPv4.PollStart()
+	t.perfMapIPv6.PollStart()
+}
+
+// Stop stops polling and closes the module, detaching all kprobes. It
+// may be called without Start; later calls wait for the first one and
+// return its error. It must not be called from a callback.
+func (t *Tracer) Stop() error {
+	t.stopOnce.Do(func() {
+		t.stateMu.Lock()
+		t.stopped = true
+		started := t.started
+		t.stateMu.Unlock()
+
+		if started {
+			t.perfMapIPv4.PollStop()
+			t.perfMapIPv6.PollStop()
+		}
+		close(t.stop)
+
+		t.attachedMu.Lock()
+		t.attached = nil
+		t.attachedMu.Unlock()
+
+		t.closeErr = t.m.Close()
+		close(t.done)
+	})
+	return t.closeErr
+}
+
+// Done returns a channel that is closed once the tracer is stopped, by
+// Stop or by Options.StopOnDecodeError
+func (t *Tracer) Done() <-chan struct{} {
+	return t.done
+}
+
+// Err returns the error that stopped the tracer with
+// Options.StopOnDecodeError, or nil
+func (t *Tracer) Err() error {
+	t.errMu.Lock()
+	defer t.errMu.Unlock()
+
+	return t.err
+}
+
+// AttachedPrograms returns the sections of the kprobes and kretprobes
+// attached by the tracer, or nil once it is stopped. It is safe to call
+// concurrently with Stop.
+func (t *Tracer) AttachedPrograms() []string {
+	t.attachedMu.Lock()
+	defer t.attachedMu.Unlock()
+
+	return append([]string(nil), t.attached...)
+}
+
+// Offsets returns the offsets found while guessing in New
+func (t *Tracer) Offsets() Offsets {
+	return t.offsets
+}
+
+// SetReceiveTimestamps makes the tracer record when each event was read
+// from its perf map, in Event.Meta. It must be called before Start.
+func (t *Tracer) SetReceiveTimestamps(enabled bool) {
+	t.receiveTimestamps = enabled
+}
+
+func (t *Tracer) metadata() *Metadata {
+	if !t.receiveTimestamps {
+		return nil
+	}
+	return &Metadata{Received: time.Now()}
+}
+
+// SetNetNSFilter restricts delivery to events from the network
+// namespaces with the given inode numbers, as found in
+// /proc/<pid>/ns/net. It must be called before Start; calling it with
+// no namespaces removes the filter.
+func (t *Tracer) SetNetNSFilter(netns ...uint32) {
+	if len(netns) == 0 {
+		t.netns = nil
+		return
+	}
+	t.netns = make(map[uint32]struct{}, len(netns))
+	for _, ns := range netns {
+		t.netns[ns] = struct{}{}
+	}
+}
+
+func (t *Tracer) deliver(e Event) {
+	if t.netns != nil {
+		if _, ok := t.netns[e.NetNS]; !ok {
+			return
+		}
+	}
+	if t.ordered == nil {
+		t.dispatch(e)
+		return
+	}
+	select {
+	case <-t.stop:
+	case t.ordered <- e:
+	}
+}
+
+func (t *Tracer) decodeError(err error) {
+	if t.callbacks.OnDecodeError != nil {
+		t.callbacks.OnDecodeError(err)
+	}
+	if t.stopOnDecodeError {
+		t.fail(err)
+	}
+}
+
+// fail records the first err and stops the tracer from a new goroutine:
+// Stop waits for the pollers, which need the consumers to keep draining
+// the channels meanwhile
+func (t *Tracer) fail(err error) {
+	t.errMu.Lock()
+	defer t.errMu.Unlock()
+
+	if t.err != nil {
+		return
+	}
+	t.err = err
+	go t.Stop()
+}
+
+func (t *Tracer) dispatch(e Event) {
+	if t.stopOnDecodeError && t.Err() != nil {
+		return
+	}
+	var cb func(Event)
+	switch e.Type {
+	case EventConnect:
+		cb = t.callbacks.OnConnect
+	case EventAccept:
+		cb = t.callbacks.OnAccept
+	case EventClose:
+		cb = t.callbacks.OnClose
+	}
+	if cb != nil {
+		cb(e)
+	}
+}
+
+// getBootTime returns the wall-clock time at which CLOCK_MONOTONIC, the
+// clock behind bpf_ktime_get_ns(), was zero
+func getBootTime() (time.Time, error) {
+	var ts syscall.Timespec
+	// CLOCK_MONOTONIC
+	_, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, 1, uintptr(unsafe.Pointer(&ts)), 0)
+	if errno != 0 {
+		return time.Time{}, fmt.Errorf("error reading monotonic clock: %v", errno)
+	}
+	return time.Now().Add(-time.Duration(ts.Nano())), nil
+}
+
+// RLIMIT_MEMLOCK is not defined in package syscall
+const rlimitMemlock = 8
+
+// raiseMemlockLimit lifts RLIMIT_MEMLOCK, which the kernel charges BPF
+// maps against before 5.11. The default of 64KB is easily exceeded and
+// map creation then fails with EPERM.
+func raiseMemlockLimit() error {
+	rlim := syscall.Rlimit{
+		Cur: ^uint64(0),
+		Max: ^uint64(0),
+	}
+	if err := syscall.Setrlimit(rlimitMemlock, &rlim); err != nil {
+		return fmt.Errorf("error raising RLIMIT_MEMLOCK: %v", err)
+	}
+	return nil
+}
+
+// raiseNofileLimit raises the RLIMIT_NOFILE soft limit to the hard limit
+func raiseNofileLimit() error {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil {
+		return fmt.Errorf("error reading RLIMIT_NOFILE: %v", err)
+	}
+	if rlim.Cur >= rlim.Max {
+		return nil
+	}
+	rlim.Cur = rlim.Max
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil {
+		return fmt.Errorf("error raising RLIMIT_NOFILE: %v", err)
+	}
+	return nil
+}
+
+// perfMapError adds a hint to err when opening the perf events of mapName
+// ran out of file descriptors. The errno may already be flattened into a
+// string by elf.InitPerfMap, so the message is matched too. nofileErr, if
+// not nil, is the error raising RLIMIT_NOFILE and is appended.
+func perfMapError(mapName string, err, nofileErr error) error {
+	msg := fmt.Sprintf("error initializing perf map %s: %v", mapName, err)
+	if errors.Is(err, syscall.EMFILE) || strings.Contains(err.Error(), syscall.EMFILE.Error()) {
+		msg += " (one fd is needed per CPU, raise the open files limit with ulimit -n)"
+	}
+	if nofileErr != nil {
+		msg += fmt.Sprintf(" (%v)", nofileErr)
+	}
+	return errors.New(msg)
+}
+
+// symbolExists reports whether the kernel symbol name is listed in
+// kallsyms, normally /proc/kallsyms
+func symbolExists(kallsyms, name string) (bool, error) {
+	f, err := os.Open(kallsyms)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// address, type, name and optionally [module]
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 3 && fields[2] == name {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
@@ -0,0 +1,225 @@
+package tracer
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/iovisor/gobpf/elf"
+)
+
+func TestNetNSFilter(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		filter []uint32
+		want   []uint32
+	}{
+		{"no filter", nil, []uint32{1, 2, 3}},
+		{"one namespace", []uint32{2}, []uint32{2}},
+		{"several namespaces", []uint32{1, 3, 4}, []uint32{1, 3}},
+	} {
+		var got []uint32
+		tr := &Tracer{
+			callbacks: Callbacks{
+				OnConnect: func(e Event) { got = append(got, e.NetNS) },
+			},
+		}
+		tr.SetNetNSFilter(tt.filter...)
+
+		for _, ns := range []uint32{1, 2, 3} {
+			tr.deliver(Event{Type: EventConnect, NetNS: ns})
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNetNSFilterReset(t *testing.T) {
+	tr := &Tracer{}
+	tr.SetNetNSFilter(1)
+	tr.SetNetNSFilter()
+	if tr.netns != nil {
+		t.Errorf("filter not removed: %v", tr.netns)
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	var got []EventType
+	record := func(e Event) { got = append(got, e.Type) }
+	tr := &Tracer{
+		callbacks: Callbacks{
+			OnConnect: record,
+			OnClose:   record,
+		},
+	}
+
+	for _, typ := range []EventType{EventConnect, EventAccept, EventClose, 0} {
+		tr.dispatch(Event{Type: typ})
+	}
+
+	want := []EventType{EventConnect, EventClose}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPerfMapError(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		err      error
+		wantHint bool
+	}{
+		{"bare EMFILE", syscall.EMFILE, true},
+		{"wrapped EMFILE", fmt.Errorf("perf_event_open: %w", syscall.EMFILE), true},
+		{"flattened EMFILE", fmt.Errorf("failed to open perf event: %v", syscall.EMFILE), true},
+		{"unrelated", errors.New("operation not permitted"), false},
+	} {
+		msg := perfMapError("tcp_event_ipv4", tt.err, nil).Error()
+		if !strings.Contains(msg, "tcp_event_ipv4") || !strings.Contains(msg, tt.err.Error()) {
+			t.Errorf("%s: %q does not contain the map and the error", tt.name, msg)
+		}
+		if got := strings.Contains(msg, "ulimit -n"); got != tt.wantHint {
+			t.Errorf("%s: hint in %q is %v, want %v", tt.name, msg, got, tt.wantHint)
+		}
+	}
+
+	nofileErr := errors.New("error raising RLIMIT_NOFILE: operation not permitted")
+	msg := perfMapError("tcp_event_ipv6", syscall.EMFILE, nofileErr).Error()
+	if !strings.Contains(msg, "ulimit -n") || !strings.Contains(msg, nofileErr.Error()) {
+		t.Errorf("%q does not contain the hint and the RLIMIT_NOFILE error", msg)
+	}
+}
+
+func TestStopOnDecodeError(t *testing.T) {
+	var decodeErrors, events int
+	tr := &Tracer{
+		callbacks: Callbacks{
+			OnConnect:     func(Event) { events++ },
+			OnDecodeError: func(error) { decodeErrors++ },
+		},
+		stopOnDecodeError: true,
+	}
+	// fail stops the tracer in the background; there is no module to
+	// close here
+	tr.stopOnce.Do(func() {})
+
+	tr.dispatch(Event{Type: EventConnect})
+	if tr.Err() != nil {
+		t.Fatalf("unexpected error before a decode error: %v", tr.Err())
+	}
+
+	first := &DecodeError{Map: "tcp_event_ipv4", Err: errors.New("first")}
+	tr.decodeError(first)
+	tr.decodeError(&DecodeError{Map: "tcp_event_ipv6", Err: errors.New("second")})
+	tr.dispatch(Event{Type: EventConnect})
+
+	if tr.Err() != first {
+		t.Errorf("Err() = %v, want %v", tr.Err(), first)
+	}
+	if decodeErrors != 2 {
+		t.Errorf("OnDecodeError called %d times, want 2", decodeErrors)
+	}
+	if events != 1 {
+		t.Errorf("%d events delivered, want 1", events)
+	}
+}
+
+func TestSymbolExists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kallsyms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kallsyms := filepath.Join(dir, "kallsyms")
+	err = ioutil.WriteFile(kallsyms, []byte(`ffffffff81000000 T _stext
+ffffffff817a1230 T tcp_v4_connect
+ffffffff817a4560 t tcp_v4_connect_part
+ffffffffc0451000 t nf_conntrack_in	[nf_conntrack]
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		want bool
+	}{
+		{"tcp_v4_connect", true},
+		{"nf_conntrack_in", true},
+		{"tcp_v4", false},
+		{"nf_conntrack", false},
+		{"tcp_v6_connect", false},
+	} {
+		got, err := symbolExists(kallsyms, tt.name)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("symbolExists(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := symbolExists(filepath.Join(dir, "missing"), "tcp_v4_connect"); err == nil {
+		t.Error("expected an error for a missing kallsyms")
+	}
+}
+
+func TestAttachedPrograms(t *testing.T) {
+	tr := &Tracer{
+		m:        &elf.Module{},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		attached: []string{"kprobe/tcp_v4_connect", "kretprobe/tcp_v4_connect"},
+	}
+
+	got := tr.AttachedPrograms()
+	want := []string{"kprobe/tcp_v4_connect", "kretprobe/tcp_v4_connect"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	got[0] = "modified"
+	if tr.attached[0] != "kprobe/tcp_v4_connect" {
+		t.Errorf("AttachedPrograms doesn't return a copy: %v", tr.attached)
+	}
+
+	if err := tr.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if got := tr.AttachedPrograms(); got != nil {
+		t.Errorf("got %v after Stop, want nil", got)
+	}
+}
+
+func TestReceiveTimestamps(t *testing.T) {
+	tr := &Tracer{}
+	if meta := tr.metadata(); meta != nil {
+		t.Errorf("got %+v by default, want nil", meta)
+	}
+
+	tr.SetReceiveTimestamps(true)
+	before := time.Now()
+	meta := tr.metadata()
+	if meta == nil {
+		t.Fatal("got nil with receive timestamps enabled")
+	}
+	if meta.Received.Before(before) || meta.Received.After(time.Now()) {
+		t.Errorf("Received = %v, not the current time", meta.Received)
+	}
+
+	tr.SetReceiveTimestamps(false)
+	if meta := tr.metadata(); meta != nil {
+		t.Errorf("got %+v once disabled, want nil", meta)
+	}
+}